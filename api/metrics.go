@@ -4,23 +4,161 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
+	"strconv"
+	"sync"
 
 	"github.com/golang/glog"
-	"github.com/golang/snappy"
+	"github.com/golang/protobuf/proto"
 	"github.com/grafana/metrictank/stats"
+	"github.com/grafana/worldping-gw/httputil"
+	"github.com/grafana/worldping-gw/limits"
 	"github.com/grafana/worldping-gw/metric_publish"
+	"github.com/prometheus/prometheus/prompb"
 	"gopkg.in/raintank/schema.v1"
 	"gopkg.in/raintank/schema.v1/msg"
 )
 
 var (
-	metricsValid    = stats.NewCounter32("metrics.http.valid")
-	metricsRejected = stats.NewCounter32("metrics.http.rejected")
-	publicOrgId     = flag.Int("public-org", -1, "orgId for public metrics")
+	metricsValid = stats.NewCounter32("metrics.http.valid")
+	publicOrgId  = flag.Int("public-org", -1, "orgId for public metrics")
+
+	// promDefaultInterval is stamped onto remote_write samples that carry
+	// no "interval" label, which is the common case for vanilla
+	// Prometheus/Grafana Agent clients (the "interval" label is a
+	// worldping-gw convention, not something those clients send).
+	promDefaultInterval = flag.Int("prom-remote-write-default-interval", 10, "fallback interval, in seconds, for remote_write samples that carry no \"interval\" label")
+
+	metricsRejectedMutex    sync.Mutex
+	metricsRejectedTotal    = stats.NewCounter32("metrics.http.rejected")
+	metricsRejectedByReason = make(map[limits.RejectReason]*stats.Counter32)
+
+	// overrides is nil unless InitLimits has been called, in which case
+	// the ingest handlers enforce it on every request.
+	overrides *limits.Overrides
 )
 
+// InitLimits constructs the per-tenant limits.Overrides used by the ingest
+// handlers below. It must be called once, after flag.Parse(), before the
+// gateway starts serving requests; until it is called, no limits are
+// enforced.
+func InitLimits() error {
+	o, err := limits.NewOverrides()
+	if err != nil {
+		return err
+	}
+	overrides = o
+	return nil
+}
+
+// limitError is the structured JSON body returned when a request is
+// rejected by the per-tenant limits.
+type limitError struct {
+	Error  string              `json:"error"`
+	Reason limits.RejectReason `json:"reason"`
+}
+
+func rejectMetrics(reason limits.RejectReason, n int) {
+	metricsRejectedMutex.Lock()
+	c, ok := metricsRejectedByReason[reason]
+	if !ok {
+		c = stats.NewCounter32("metrics.http.rejected." + string(reason))
+		metricsRejectedByReason[reason] = c
+	}
+	metricsRejectedMutex.Unlock()
+	c.Add(n)
+	metricsRejectedTotal.Add(n)
+}
+
+// statusForReason maps a limits.RejectReason to the HTTP status returned to
+// the client: rate limiting is a 429, everything else is a 400.
+func statusForReason(reason limits.RejectReason) int {
+	if reason == limits.ReasonRateLimited {
+		return 429
+	}
+	return 400
+}
+
+// checkRequestLimits enforces the per-org request-level limits (ingestion
+// enabled, max samples per request, rate limit) for numSamples about to be
+// ingested for orgId. It writes the rejection response itself and returns
+// false if the request should not proceed.
+func checkRequestLimits(ctx *Context, orgId int, numSamples int) bool {
+	if overrides == nil {
+		return true
+	}
+	if rejErr := overrides.CheckRequest(orgId, numSamples); rejErr != nil {
+		rejectMetrics(rejErr.Reason, numSamples)
+		ctx.JSON(statusForReason(rejErr.Reason), limitError{Error: rejErr.Error(), Reason: rejErr.Reason})
+		return false
+	}
+	return true
+}
+
+// checkRequestLimitsByOrg enforces checkRequestLimits per destination org
+// rather than once for the whole request. For a non-admin request every
+// metric is destined for ctx.OrgId, but an admin request can carry metrics
+// for any number of orgs (each m.OrgId), and each of those orgs must be
+// limited on its own traffic rather than all being charged against (or
+// exempted via) ctx.OrgId's bucket.
+func checkRequestLimitsByOrg(ctx *Context, metrics []*schema.MetricData) bool {
+	if !ctx.IsAdmin {
+		return checkRequestLimits(ctx, ctx.OrgId, len(metrics))
+	}
+	counts := make(map[int]int, len(metrics))
+	for _, m := range metrics {
+		counts[m.OrgId]++
+	}
+	for orgId, n := range counts {
+		if !checkRequestLimits(ctx, orgId, n) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkMetricLabels enforces the per-org label name/value length limits for
+// a single metric. Call it before the metric's tags are discarded. It
+// writes the rejection response itself and returns false if the request
+// should not proceed.
+func checkMetricLabels(ctx *Context, orgId int, m *schema.MetricData) bool {
+	if overrides == nil {
+		return true
+	}
+	if rejErr := overrides.CheckMetric(orgId, m.Name, m.Tags); rejErr != nil {
+		rejectMetrics(rejErr.Reason, 1)
+		ctx.JSON(statusForReason(rejErr.Reason), limitError{Error: rejErr.Error(), Reason: rejErr.Reason})
+		return false
+	}
+	return true
+}
+
+// checkSeriesLimit enforces the per-org series-count limit for a single
+// metric. Call it after m.SetId() has populated m.Id. It writes the
+// rejection response itself and returns false if the request should not
+// proceed.
+func checkSeriesLimit(ctx *Context, orgId int, m *schema.MetricData) bool {
+	if overrides == nil {
+		return true
+	}
+	if rejErr := overrides.CheckSeries(orgId, m.Id); rejErr != nil {
+		rejectMetrics(rejErr.Reason, 1)
+		ctx.JSON(statusForReason(rejErr.Reason), limitError{Error: rejErr.Error(), Reason: rejErr.Reason})
+		return false
+	}
+	return true
+}
+
+// GetLimits returns the effective limits.Limits for the authenticated org,
+// or the org impersonated via X-Tsdb-Org when the caller is an admin (Auth
+// has already resolved that impersonation into ctx.OrgId).
+func GetLimits(ctx *Context) {
+	if overrides == nil {
+		ctx.JSON(200, limits.DefaultLimits())
+		return
+	}
+	ctx.JSON(200, overrides.ForOrg(ctx.OrgId))
+}
+
 func Metrics(ctx *Context) {
 	contentType := ctx.Req.Header.Get("Content-Type")
 	switch contentType {
@@ -30,16 +168,194 @@ func Metrics(ctx *Context) {
 		metricsBinary(ctx, true)
 	case "application/json":
 		metricsJson(ctx)
+	case "application/x-protobuf":
+		if ctx.Req.Header.Get("X-Prometheus-Remote-Write-Version") == "0.1.0" {
+			metricsPromRemoteWrite(ctx)
+			return
+		}
+		ctx.JSON(400, "unsupported x-protobuf payload, missing X-Prometheus-Remote-Write-Version")
 	default:
 		ctx.JSON(400, fmt.Sprintf("unknown content-type: %s", contentType))
 	}
 }
 
+// metricsPromRemoteWrite accepts a Prometheus remote_write request (snappy
+// framed protobuf WriteRequest) and publishes each TimeSeries as one
+// schema.MetricData (see promTimeSeriesToMetricData), so that vanilla Prometheus/Grafana Agent remote_write
+// clients can feed the same Kafka/Metrictank pipeline as the other ingest
+// formats.
+func metricsPromRemoteWrite(ctx *Context) {
+	defer ctx.Req.Request.Body.Close()
+	if ctx.Req.Request.Body == nil {
+		ctx.JSON(400, "no data included in request.")
+		return
+	}
+	compressed, err := httputil.DecodeBody(ctx.Req.Request)
+	if err != nil {
+		if err == httputil.ErrBodyTooLarge {
+			ctx.JSON(413, err.Error())
+			return
+		}
+		glog.Errorf("unable to read request body. %s", err)
+		ctx.JSON(500, err)
+		return
+	}
+	body, err := httputil.DecodeSnappyBlock(compressed)
+	if err != nil {
+		if err == httputil.ErrBodyTooLarge {
+			ctx.JSON(413, err.Error())
+			return
+		}
+		ctx.JSON(400, fmt.Sprintf("unable to decode snappy payload. %s", err))
+		return
+	}
+	var req prompb.WriteRequest
+	if err := proto.Unmarshal(body, &req); err != nil {
+		ctx.JSON(400, fmt.Sprintf("unable to unmarshal WriteRequest. %s", err))
+		return
+	}
+
+	numSamples := 0
+	for _, ts := range req.Timeseries {
+		numSamples += len(ts.Samples)
+	}
+	if !checkRequestLimits(ctx, ctx.OrgId, numSamples) {
+		return
+	}
+
+	metrics := make([]*schema.MetricData, 0)
+	for _, ts := range req.Timeseries {
+		m := promTimeSeriesToMetricData(ts)
+		if m == nil {
+			continue
+		}
+		if ctx.IsAdmin {
+			// unlike the JSON/binary formats, a remote_write TimeSeries has
+			// no field for the caller to specify a destination OrgId, so
+			// admin requests are stamped with ctx.OrgId (which Auth() may
+			// already have set to an impersonated org via X-Tsdb-Org), same
+			// as the non-admin branch below.
+			m.OrgId = ctx.OrgId
+			if !checkMetricLabels(ctx, m.OrgId, m) {
+				return
+			}
+			if err := m.Validate(); err != nil {
+				rejectMetrics(limits.ReasonInvalidMetric, 1)
+				ctx.JSON(400, err.Error())
+				return
+			}
+			m.SetId()
+			if !checkSeriesLimit(ctx, m.OrgId, m) {
+				return
+			}
+			metrics = append(metrics, m)
+
+			// if this is a public metric, lets create a copy that
+			// uses the updated publicOrgId. It's appended to the slice
+			// this loop is ranging over, so it won't be visited again -
+			// run the same checks on it here rather than relying on the
+			// loop to reach it later.
+			if m.OrgId == -1 && *publicOrgId != -1 {
+				public := *m
+				public.OrgId = *publicOrgId
+				if !checkMetricLabels(ctx, public.OrgId, &public) {
+					return
+				}
+				public.SetId()
+				if !checkSeriesLimit(ctx, public.OrgId, &public) {
+					return
+				}
+				metrics = append(metrics, &public)
+			}
+		} else {
+			m.OrgId = ctx.OrgId
+			if !checkMetricLabels(ctx, m.OrgId, m) {
+				return
+			}
+			if err := m.Validate(); err != nil {
+				rejectMetrics(limits.ReasonInvalidMetric, 1)
+				ctx.JSON(400, err.Error())
+				return
+			}
+			m.SetId()
+			if !checkSeriesLimit(ctx, m.OrgId, m) {
+				return
+			}
+			metrics = append(metrics, m)
+		}
+	}
+
+	metricsValid.Add(len(metrics))
+	err = metric_publish.Publish(ctx.Req.Request.Context(), metrics)
+	if err != nil {
+		glog.Errorf("failed to publish metrics. %s", err)
+		ctx.JSON(500, err)
+		return
+	}
+	ctx.JSON(200, "ok")
+}
+
+// promTimeSeriesToMetricData converts a single Prometheus remote_write
+// TimeSeries (which carries one or more Samples sharing the same Labels)
+// into a schema.MetricData. The __name__ label becomes Name/Metric, the
+// "interval" and "unit" labels map to their schema.MetricData equivalents,
+// and all remaining labels become tags. Samples with no "interval" label
+// (the normal case for clients that don't know about that worldping-gw
+// convention) fall back to -prom-remote-write-default-interval. The most
+// recent sample is used as the metric's value, since schema.MetricData
+// carries a single point.
+func promTimeSeriesToMetricData(ts *prompb.TimeSeries) *schema.MetricData {
+	if len(ts.Samples) == 0 {
+		return nil
+	}
+
+	name := ""
+	interval := 0
+	unit := ""
+	tags := make([]string, 0, len(ts.Labels))
+	for _, l := range ts.Labels {
+		switch l.Name {
+		case "__name__":
+			name = l.Value
+		case "interval":
+			if iv, err := strconv.Atoi(l.Value); err == nil {
+				interval = iv
+			}
+		case "unit":
+			unit = l.Value
+		default:
+			tags = append(tags, l.Name+"="+l.Value)
+		}
+	}
+	if name == "" {
+		return nil
+	}
+	if interval == 0 {
+		interval = *promDefaultInterval
+	}
+
+	sample := ts.Samples[len(ts.Samples)-1]
+	return &schema.MetricData{
+		Name:     name,
+		Metric:   name,
+		Interval: interval,
+		Value:    sample.Value,
+		Unit:     unit,
+		Mtype:    "gauge",
+		Time:     sample.Timestamp / 1000,
+		Tags:     tags,
+	}
+}
+
 func metricsJson(ctx *Context) {
 	defer ctx.Req.Request.Body.Close()
 	if ctx.Req.Request.Body != nil {
-		body, err := ioutil.ReadAll(ctx.Req.Request.Body)
+		body, err := httputil.DecodeBody(ctx.Req.Request)
 		if err != nil {
+			if err == httputil.ErrBodyTooLarge {
+				ctx.JSON(413, err.Error())
+				return
+			}
 			glog.Errorf("unable to read request body. %s", err)
 		}
 		metrics := make([]*schema.MetricData, 0)
@@ -49,6 +365,10 @@ func metricsJson(ctx *Context) {
 			return
 		}
 
+		if !checkRequestLimitsByOrg(ctx, metrics) {
+			return
+		}
+
 		if ctx.IsAdmin {
 			for _, m := range metrics {
 				m.Metric = m.Name
@@ -56,22 +376,37 @@ func metricsJson(ctx *Context) {
 				if m.Mtype == "" {
 					m.Mtype = "gauge"
 				}
+				if !checkMetricLabels(ctx, m.OrgId, m) {
+					return
+				}
 				m.Tags = nil
 
 				if err := m.Validate(); err != nil {
-					metricsRejected.Add(len(metrics))
+					rejectMetrics(limits.ReasonInvalidMetric, len(metrics))
 					ctx.JSON(400, err.Error())
 					return
 				}
 
 				m.SetId()
+				if !checkSeriesLimit(ctx, m.OrgId, m) {
+					return
+				}
 
 				// if this is a public metric, lets create a copy that
-				// uses the updated publicOrgId
+				// uses the updated publicOrgId. It's appended to metrics
+				// while this loop is ranging over metrics, so it won't be
+				// visited again - run the same checks on it here rather
+				// than relying on the loop to reach it later.
 				if m.OrgId == -1 && *publicOrgId != -1 {
 					public := *m
-					m.OrgId = *publicOrgId
+					public.OrgId = *publicOrgId
+					if !checkMetricLabels(ctx, public.OrgId, &public) {
+						return
+					}
 					public.SetId()
+					if !checkSeriesLimit(ctx, public.OrgId, &public) {
+						return
+					}
 					metrics = append(metrics, &public)
 				}
 			}
@@ -83,17 +418,23 @@ func metricsJson(ctx *Context) {
 				if m.Mtype == "" {
 					m.Mtype = "gauge"
 				}
+				if !checkMetricLabels(ctx, m.OrgId, m) {
+					return
+				}
 				m.Tags = nil
 				if err := m.Validate(); err != nil {
-					metricsRejected.Add(len(metrics))
+					rejectMetrics(limits.ReasonInvalidMetric, len(metrics))
 					ctx.JSON(400, err.Error())
 					return
 				}
 				m.SetId()
+				if !checkSeriesLimit(ctx, m.OrgId, m) {
+					return
+				}
 			}
 		}
 		metricsValid.Add(len(metrics))
-		err = metric_publish.Publish(metrics)
+		err = metric_publish.Publish(ctx.Req.Request.Context(), metrics)
 		if err != nil {
 			glog.Errorf("failed to publish metrics. %s", err)
 			ctx.JSON(500, err)
@@ -106,21 +447,37 @@ func metricsJson(ctx *Context) {
 }
 
 func metricsBinary(ctx *Context, compressed bool) {
-	var body io.ReadCloser
-	if compressed {
-		body = ioutil.NopCloser(snappy.NewReader(ctx.Req.Request.Body))
-	} else {
-		body = ctx.Req.Request.Body
-	}
-	defer body.Close()
+	defer ctx.Req.Request.Body.Close()
 
 	if ctx.Req.Request.Body != nil {
-		body, err := ioutil.ReadAll(body)
+		raw, err := httputil.DecodeBody(ctx.Req.Request)
 		if err != nil {
+			if err == httputil.ErrBodyTooLarge {
+				ctx.JSON(413, err.Error())
+				return
+			}
 			glog.Errorf("unable to read request body. %s", err)
 			ctx.JSON(500, err)
 			return
 		}
+
+		body := raw
+		if compressed {
+			// rt-metric-binary-snappy uses the streaming/framed Snappy
+			// format (https://github.com/google/snappy/blob/master/framing_format.txt),
+			// not the raw block format used by the unrelated remote_write
+			// path above.
+			body, err = httputil.DecodeSnappyFramed(raw)
+			if err != nil {
+				if err == httputil.ErrBodyTooLarge {
+					ctx.JSON(413, err.Error())
+					return
+				}
+				glog.Errorf("unable to decode snappy payload. %s", err)
+				ctx.JSON(500, err)
+				return
+			}
+		}
 		metricData := new(msg.MetricData)
 		err = metricData.InitFromMsg(body)
 		if err != nil {
@@ -136,6 +493,10 @@ func metricsBinary(ctx *Context, compressed bool) {
 			return
 		}
 
+		if !checkRequestLimitsByOrg(ctx, metricData.Metrics) {
+			return
+		}
+
 		if ctx.IsAdmin {
 			for _, m := range metricData.Metrics {
 				m.Metric = m.Name
@@ -143,22 +504,37 @@ func metricsBinary(ctx *Context, compressed bool) {
 				if m.Mtype == "" {
 					m.Mtype = "gauge"
 				}
+				if !checkMetricLabels(ctx, m.OrgId, m) {
+					return
+				}
 				m.Tags = nil
 
 				if err := m.Validate(); err != nil {
-					metricsRejected.Add(len(metricData.Metrics))
+					rejectMetrics(limits.ReasonInvalidMetric, len(metricData.Metrics))
 					ctx.JSON(400, err.Error())
 					return
 				}
 
 				m.SetId()
+				if !checkSeriesLimit(ctx, m.OrgId, m) {
+					return
+				}
 
 				// if this is a public metric, lets create a copy that
-				// uses the updated publicOrgId
+				// uses the updated publicOrgId. It's appended to
+				// metricData.Metrics while this loop is ranging over it, so
+				// it won't be visited again - run the same checks on it
+				// here rather than relying on the loop to reach it later.
 				if m.OrgId == -1 && *publicOrgId != -1 {
 					public := *m
-					m.OrgId = *publicOrgId
+					public.OrgId = *publicOrgId
+					if !checkMetricLabels(ctx, public.OrgId, &public) {
+						return
+					}
 					public.SetId()
+					if !checkSeriesLimit(ctx, public.OrgId, &public) {
+						return
+					}
 					metricData.Metrics = append(metricData.Metrics, &public)
 				}
 			}
@@ -170,17 +546,23 @@ func metricsBinary(ctx *Context, compressed bool) {
 				if m.Mtype == "" {
 					m.Mtype = "gauge"
 				}
+				if !checkMetricLabels(ctx, m.OrgId, m) {
+					return
+				}
 				m.Tags = nil
 				if err := m.Validate(); err != nil {
-					metricsRejected.Add(len(metricData.Metrics))
+					rejectMetrics(limits.ReasonInvalidMetric, len(metricData.Metrics))
 					ctx.JSON(400, err.Error())
 					return
 				}
 				m.SetId()
+				if !checkSeriesLimit(ctx, m.OrgId, m) {
+					return
+				}
 			}
 		}
 		metricsValid.Add(len(metricData.Metrics))
-		err = metric_publish.Publish(metricData.Metrics)
+		err = metric_publish.Publish(ctx.Req.Request.Context(), metricData.Metrics)
 		if err != nil {
 			glog.Errorf("failed to publish metrics. %s", err)
 			ctx.JSON(500, err)
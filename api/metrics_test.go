@@ -0,0 +1,75 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestPromTimeSeriesToMetricData(t *testing.T) {
+	ts := &prompb.TimeSeries{
+		Labels: []prompb.Label{
+			{Name: "__name__", Value: "cpu.usage"},
+			{Name: "unit", Value: "percent"},
+			{Name: "host", Value: "a"},
+		},
+		Samples: []prompb.Sample{
+			{Value: 1, Timestamp: 1000},
+			{Value: 2, Timestamp: 2000},
+		},
+	}
+
+	m := promTimeSeriesToMetricData(ts)
+	if m == nil {
+		t.Fatal("expected a non-nil MetricData")
+	}
+	if m.Name != "cpu.usage" || m.Metric != "cpu.usage" {
+		t.Fatalf("expected __name__ to map to Name/Metric, got %q/%q", m.Name, m.Metric)
+	}
+	if m.Unit != "percent" {
+		t.Fatalf("expected unit label to map to Unit, got %q", m.Unit)
+	}
+	if len(m.Tags) != 1 || m.Tags[0] != "host=a" {
+		t.Fatalf("expected remaining labels to become tags, got %v", m.Tags)
+	}
+	if m.Value != 2 || m.Time != 2 {
+		t.Fatalf("expected the most recent sample to be used, got value=%v time=%v", m.Value, m.Time)
+	}
+	if m.Interval != *promDefaultInterval {
+		t.Fatalf("expected no \"interval\" label to fall back to the default, got %d", m.Interval)
+	}
+}
+
+func TestPromTimeSeriesToMetricDataExplicitInterval(t *testing.T) {
+	ts := &prompb.TimeSeries{
+		Labels: []prompb.Label{
+			{Name: "__name__", Value: "cpu.usage"},
+			{Name: "interval", Value: "60"},
+		},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+	}
+
+	m := promTimeSeriesToMetricData(ts)
+	if m == nil || m.Interval != 60 {
+		t.Fatalf("expected an explicit interval label to be honored, got %+v", m)
+	}
+}
+
+func TestPromTimeSeriesToMetricDataNoSamples(t *testing.T) {
+	ts := &prompb.TimeSeries{
+		Labels: []prompb.Label{{Name: "__name__", Value: "cpu.usage"}},
+	}
+	if m := promTimeSeriesToMetricData(ts); m != nil {
+		t.Fatalf("expected a series with no samples to be dropped, got %+v", m)
+	}
+}
+
+func TestPromTimeSeriesToMetricDataNoName(t *testing.T) {
+	ts := &prompb.TimeSeries{
+		Labels:  []prompb.Label{{Name: "host", Value: "a"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+	}
+	if m := promTimeSeriesToMetricData(ts); m != nil {
+		t.Fatalf("expected a series with no __name__ label to be dropped, got %+v", m)
+	}
+}
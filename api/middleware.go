@@ -13,6 +13,7 @@ import (
 
 	"github.com/golang/glog"
 	"github.com/grafana/metrictank/stats"
+	"github.com/grafana/worldping-gw/jwtauth"
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
 	otLog "github.com/opentracing/opentracing-go/log"
@@ -20,6 +21,32 @@ import (
 	"gopkg.in/macaron.v1"
 )
 
+// jwtValidator is nil unless InitJWTAuth has been called and -jwt-jwks-url
+// or -jwt-secret is set, in which case Auth() accepts JWT bearer tokens
+// alongside the existing API-key plugin.
+var jwtValidator *jwtauth.Validator
+
+// InitJWTAuth constructs the optional JWT validator used by Auth() to
+// accept Bearer tokens issued by an OIDC provider (Keycloak, Auth0, ...)
+// alongside the existing API-key plugin. It must be called once at
+// startup, after flag.Parse(); if neither -jwt-jwks-url nor -jwt-secret is
+// set, JWT auth stays disabled and Auth() behaves exactly as before.
+func InitJWTAuth() error {
+	v, err := jwtauth.NewValidator()
+	if err != nil {
+		return err
+	}
+	jwtValidator = v
+	return nil
+}
+
+// looksLikeJWT reports whether key has the three dot-separated segments of
+// a JWT, so Auth() can route it to the JWT validator instead of the
+// opaque-API-key plugin.
+func looksLikeJWT(key string) bool {
+	return strings.Count(key, ".") == 2
+}
+
 type Context struct {
 	*macaron.Context
 	*auth.User
@@ -67,15 +94,25 @@ func (a *Api) Auth() macaron.Handler {
 			ctx.JSON(401, "Unauthorized")
 			return
 		}
-		user, err := a.authPlugin.Auth(key)
-		if err != nil {
-			if err == auth.ErrInvalidKey || err == auth.ErrInvalidOrgId {
-				ctx.JSON(401, err.Error())
+
+		var user *auth.User
+		if jwtValidator != nil && looksLikeJWT(key) {
+			user, err = jwtValidator.Validate(key)
+		}
+		// key isn't a JWT (or didn't validate as one, e.g. an opaque API
+		// key that happens to contain two dots) - fall back to the
+		// existing key-based plugin rather than hard-failing.
+		if user == nil {
+			user, err = a.authPlugin.Auth(key)
+			if err != nil {
+				if err == auth.ErrInvalidKey || err == auth.ErrInvalidOrgId {
+					ctx.JSON(401, err.Error())
+					return
+				}
+				glog.Errorf("failed to perform authentication: %q", err.Error())
+				ctx.JSON(500, err.Error())
 				return
 			}
-			glog.Errorf("failed to perform authentication: %q", err.Error())
-			ctx.JSON(500, err.Error())
-			return
 		}
 		// allow admin users to impersonate other orgs.
 		if user.IsAdmin {
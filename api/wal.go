@@ -0,0 +1,27 @@
+package api
+
+import (
+	"fmt"
+
+	"github.com/grafana/worldping-gw/metric_publish"
+)
+
+// FlushWAL rotates the current WAL segment and synchronously replays the
+// backlog into the publisher, for operators draining a segment by hand.
+func FlushWAL(ctx *Context) {
+	if err := metric_publish.Flush(); err != nil {
+		ctx.JSON(500, fmt.Sprintf("failed to flush wal. %s", err))
+		return
+	}
+	ctx.JSON(200, "ok")
+}
+
+// RotateWAL forces the current WAL segment to be closed and a new one
+// opened, without waiting for the replayer to drain it.
+func RotateWAL(ctx *Context) {
+	if err := metric_publish.Rotate(); err != nil {
+		ctx.JSON(500, fmt.Sprintf("failed to rotate wal. %s", err))
+		return
+	}
+	ctx.JSON(200, "ok")
+}
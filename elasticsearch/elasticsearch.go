@@ -0,0 +1,84 @@
+// Package elasticsearch proxies the `_msearch` endpoint used by the
+// worldping Grafana app through to the backing Elasticsearch cluster.
+package elasticsearch
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/opentracing/opentracing-go/ext"
+	"gopkg.in/macaron.v1"
+
+	"github.com/grafana/worldping-gw/httputil"
+	"github.com/grafana/worldping-gw/spanlogger"
+)
+
+// IndexName is the base name of the per-day worldping event index, e.g.
+// "worldping-events-2019-01-02".
+const IndexName = "worldping-events"
+
+var (
+	esUrl      = flag.String("elasticsearch-url", "http://localhost:9200", "base URL of the backing Elasticsearch cluster")
+	httpClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// Proxy forwards c's request body to the backing Elasticsearch cluster and
+// copies the response back, tracing the backend call as a child of the
+// request's server span.
+func Proxy(orgId int, c *macaron.Context) {
+	path := c.Params("*")
+	if path == "" {
+		path = "_msearch"
+	}
+
+	span, ctx := spanlogger.New(c.Req.Request.Context(), "elasticsearch.Proxy")
+	defer span.Finish()
+	ext.DBType.Set(span.Span, "elasticsearch")
+	span.SetTag("db.instance", IndexName)
+	span.SetTag("db.method", c.Req.Request.Method)
+	span.SetTag("http.path", path)
+	span.SetTag("org.id", orgId)
+
+	body, err := httputil.DecodeBody(c.Req.Request)
+	if err != nil {
+		if err == httputil.ErrBodyTooLarge {
+			c.JSON(413, err.Error())
+			return
+		}
+		span.Errorf("elasticsearch proxy: failed to read request body: %s", err)
+		c.JSON(500, err.Error())
+		return
+	}
+
+	req, err := http.NewRequest(c.Req.Request.Method, *esUrl+"/"+path, bytes.NewReader(body))
+	if err != nil {
+		span.Errorf("elasticsearch proxy: failed to build backend request: %s", err)
+		c.JSON(500, err.Error())
+		return
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", c.Req.Request.Header.Get("Content-Type"))
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		span.Errorf("elasticsearch proxy: request to %s failed: %s", *esUrl, err)
+		c.JSON(502, err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	span.SetTag("http.status_code", resp.StatusCode)
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		span.Errorf("elasticsearch proxy: failed to read backend response: %s", err)
+		c.JSON(500, err.Error())
+		return
+	}
+
+	c.Resp.Header().Set("Content-Type", "application/json")
+	c.Resp.WriteHeader(resp.StatusCode)
+	c.Resp.Write(respBody)
+}
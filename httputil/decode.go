@@ -0,0 +1,110 @@
+// Package httputil holds small HTTP helpers shared by the api and
+// elasticsearch packages.
+package httputil
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/golang/snappy"
+	"github.com/grafana/metrictank/stats"
+)
+
+var (
+	maxDecompressedBodySize = flag.Int64("max-decompressed-body-size", 100<<20, "maximum allowed size, in bytes, of a decompressed request body; larger bodies are rejected with 413")
+
+	decompressedBytes = stats.NewMeter32("metrics.http.decompressed_bytes", false)
+	compressionRatio  = stats.NewMeter32("metrics.http.compression_ratio", false)
+)
+
+// ErrBodyTooLarge is returned by DecodeBody when the decompressed payload
+// would exceed -max-decompressed-body-size.
+var ErrBodyTooLarge = errors.New("decompressed request body exceeds the maximum allowed size")
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// DecodeBody reads req's body in full, transparently decompressing it
+// first when Content-Encoding is "gzip" or "deflate", so callers can
+// decode the bespoke formats (snappy, msgp, JSON) without caring whether
+// the client also compressed the transport. It guards against zip-bomb
+// payloads by aborting, with ErrBodyTooLarge, once more than
+// -max-decompressed-body-size bytes have been produced.
+func DecodeBody(req *http.Request) ([]byte, error) {
+	cr := &countingReader{r: req.Body}
+	var reader io.Reader = cr
+	switch req.Header.Get("Content-Encoding") {
+	case "gzip":
+		gz, err := gzip.NewReader(cr)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = gz
+	case "deflate":
+		fl := flate.NewReader(cr)
+		defer fl.Close()
+		reader = fl
+	}
+
+	limited := io.LimitReader(reader, *maxDecompressedBodySize+1)
+	body, err := ioutil.ReadAll(limited)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > *maxDecompressedBodySize {
+		return nil, ErrBodyTooLarge
+	}
+
+	decompressedBytes.Add(len(body))
+	if cr.n > 0 {
+		compressionRatio.Add(int(float64(len(body)) / float64(cr.n) * 100))
+	}
+	return body, nil
+}
+
+// DecodeSnappyBlock decodes src as a raw (non-framed) Snappy block, as used
+// by Prometheus remote_write, bounding the decoded size against
+// -max-decompressed-body-size before allocating it. snappy.Decode alone
+// trusts the length prefix embedded in src, so without this check a small
+// payload can claim an arbitrarily large decoded size and OOM the process.
+func DecodeSnappyBlock(src []byte) ([]byte, error) {
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if int64(n) > *maxDecompressedBodySize {
+		return nil, ErrBodyTooLarge
+	}
+	return snappy.Decode(nil, src)
+}
+
+// DecodeSnappyFramed decodes src as the streaming/framed Snappy format (used
+// by the rt-metric-binary-snappy content type), bounding the decoded size
+// against -max-decompressed-body-size the same way DecodeBody bounds
+// Content-Encoding decompression.
+func DecodeSnappyFramed(src []byte) ([]byte, error) {
+	limited := io.LimitReader(snappy.NewReader(bytes.NewReader(src)), *maxDecompressedBodySize+1)
+	body, err := ioutil.ReadAll(limited)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > *maxDecompressedBodySize {
+		return nil, ErrBodyTooLarge
+	}
+	return body, nil
+}
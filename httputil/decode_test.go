@@ -0,0 +1,80 @@
+package httputil
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newRequest(t *testing.T, body []byte, contentEncoding string) *http.Request {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	return req
+}
+
+func TestDecodeBodyUncompressed(t *testing.T) {
+	want := []byte("hello world")
+	got, err := DecodeBody(newRequest(t, want, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestDecodeBodyGzip(t *testing.T) {
+	want := []byte("hello gzipped world")
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := DecodeBody(newRequest(t, buf.Bytes(), "gzip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestDecodeBodyTooLarge(t *testing.T) {
+	old := *maxDecompressedBodySize
+	*maxDecompressedBodySize = 4
+	defer func() { *maxDecompressedBodySize = old }()
+
+	_, err := DecodeBody(newRequest(t, []byte("way too many bytes"), ""))
+	if err != ErrBodyTooLarge {
+		t.Fatalf("expected ErrBodyTooLarge, got %v", err)
+	}
+}
+
+func TestDecodeBodyGzipBombGuard(t *testing.T) {
+	old := *maxDecompressedBodySize
+	*maxDecompressedBodySize = 4
+	defer func() { *maxDecompressedBodySize = old }()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte("way more than four decompressed bytes")); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := DecodeBody(newRequest(t, buf.Bytes(), "gzip"))
+	if err != ErrBodyTooLarge {
+		t.Fatalf("expected ErrBodyTooLarge for an oversized decompressed gzip body, got %v", err)
+	}
+}
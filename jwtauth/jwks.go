@@ -0,0 +1,121 @@
+package jwtauth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// jwksHTTPClient is used to fetch the JWKS document, with the same timeout
+// as the Elasticsearch proxy's backend client (elasticsearch.httpClient) so
+// an unresponsive identity provider can't hang gateway startup or the
+// periodic refresh goroutine indefinitely.
+var jwksHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// jwksCache holds the RSA public keys fetched from a JWKS endpoint, keyed
+// by "kid", refreshing them on -jwt-jwks-refresh-interval so key rotation
+// on the identity provider doesn't require a gateway restart.
+type jwksCache struct {
+	url             string
+	refreshInterval time.Duration
+
+	mu   sync.RWMutex
+	keys map[string]*rsa.PublicKey
+}
+
+func newJWKSCache(url string, refreshInterval time.Duration) (*jwksCache, error) {
+	c := &jwksCache{url: url, refreshInterval: refreshInterval}
+	if err := c.refresh(); err != nil {
+		return nil, err
+	}
+	go c.refreshLoop()
+	return c, nil
+}
+
+func (c *jwksCache) refreshLoop() {
+	ticker := time.NewTicker(c.refreshInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := c.refresh(); err != nil {
+			glog.Errorf("jwtauth: failed to refresh jwks from %s: %s", c.url, err)
+		}
+	}
+}
+
+type jwks struct {
+	Keys []struct {
+		Kid string `json:"kid"`
+		Kty string `json:"kty"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+func (c *jwksCache) refresh() error {
+	resp, err := jwksHTTPClient.Get(c.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var doc jwks
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return err
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(doc.Keys))
+	for _, k := range doc.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		pub, err := rsaPublicKeyFromJWK(k.N, k.E)
+		if err != nil {
+			glog.Warningf("jwtauth: skipping jwks key %q: %s", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+
+	c.mu.Lock()
+	c.keys = keys
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *jwksCache) Key(kid string) (*rsa.PublicKey, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	key, ok := c.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("jwtauth: no jwks key for kid %q", kid)
+	}
+	return key, nil
+}
+
+func rsaPublicKeyFromJWK(nStr, eStr string) (*rsa.PublicKey, error) {
+	nBytes, err := base64.RawURLEncoding.DecodeString(nStr)
+	if err != nil {
+		return nil, err
+	}
+	eBytes, err := base64.RawURLEncoding.DecodeString(eStr)
+	if err != nil {
+		return nil, err
+	}
+
+	e := 0
+	for _, b := range eBytes {
+		e = e<<8 | int(b)
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(nBytes),
+		E: e,
+	}, nil
+}
@@ -0,0 +1,129 @@
+// Package jwtauth validates JWT bearer tokens (RS256 against a JWKS
+// endpoint, or HS256 against a shared secret) and maps their claims onto
+// auth.User, so the gateway can sit behind an OIDC provider (Keycloak,
+// Auth0, ...) without abandoning the existing API-key auth plugin.
+package jwtauth
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/raintank/tsdb-gw/auth"
+)
+
+var (
+	jwksURL             = flag.String("jwt-jwks-url", "", "URL of a JWKS endpoint used to validate RS256 bearer tokens")
+	jwtSecret           = flag.String("jwt-secret", "", "shared secret used to validate HS256 bearer tokens")
+	jwtIssuer           = flag.String("jwt-issuer", "", "if set, reject tokens whose iss claim does not match")
+	jwtAudience         = flag.String("jwt-audience", "", "if set, reject tokens whose aud claim does not contain this value")
+	jwtOrgClaim         = flag.String("jwt-org-claim", "org_id", "claim used to populate the authenticated OrgId")
+	jwtRoleClaim        = flag.String("jwt-role-claim", "role", "claim used to determine admin status")
+	jwtAdminRole        = flag.String("jwt-admin-role", "admin", "value of -jwt-role-claim that grants admin access")
+	jwksRefreshInterval = flag.Duration("jwt-jwks-refresh-interval", 5*time.Minute, "how often the JWKS keyset is refreshed")
+)
+
+// Validator validates bearer tokens and maps their claims onto auth.User.
+type Validator struct {
+	secret []byte
+	jwks   *jwksCache
+}
+
+// NewValidator builds a Validator from -jwt-jwks-url / -jwt-secret. It
+// returns a nil Validator and a nil error when neither flag is set, so
+// JWT auth is an opt-in feature: callers should treat a nil *Validator as
+// "JWT auth disabled".
+func NewValidator() (*Validator, error) {
+	if *jwksURL == "" && *jwtSecret == "" {
+		return nil, nil
+	}
+
+	v := &Validator{}
+	if *jwtSecret != "" {
+		v.secret = []byte(*jwtSecret)
+	}
+	if *jwksURL != "" {
+		jwks, err := newJWKSCache(*jwksURL, *jwksRefreshInterval)
+		if err != nil {
+			return nil, err
+		}
+		v.jwks = jwks
+	}
+	return v, nil
+}
+
+// Validate parses and verifies tokenString (signature, exp, nbf, and
+// optionally iss/aud) and maps its claims onto an auth.User.
+func (v *Validator) Validate(tokenString string) (*auth.User, error) {
+	token, err := jwt.Parse(tokenString, v.keyFunc)
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("jwtauth: invalid token")
+	}
+
+	if *jwtIssuer != "" {
+		if !claims.VerifyIssuer(*jwtIssuer, true) {
+			return nil, fmt.Errorf("jwtauth: unexpected issuer")
+		}
+	}
+	if *jwtAudience != "" {
+		if !claims.VerifyAudience(*jwtAudience, true) {
+			return nil, fmt.Errorf("jwtauth: unexpected audience")
+		}
+	}
+
+	orgClaim, ok := claims[*jwtOrgClaim]
+	if !ok {
+		return nil, fmt.Errorf("jwtauth: token missing %q claim", *jwtOrgClaim)
+	}
+	orgId, err := claimToInt(orgClaim)
+	if err != nil {
+		return nil, fmt.Errorf("jwtauth: invalid %q claim: %s", *jwtOrgClaim, err)
+	}
+
+	isAdmin := false
+	if role, ok := claims[*jwtRoleClaim].(string); ok && role == *jwtAdminRole {
+		isAdmin = true
+	}
+
+	return &auth.User{OrgId: orgId, IsAdmin: isAdmin}, nil
+}
+
+// keyFunc resolves the key used to verify token, based on its signing
+// method: the JWKS keyset (looked up by "kid") for RS256, or the shared
+// secret for HS256.
+func (v *Validator) keyFunc(token *jwt.Token) (interface{}, error) {
+	switch token.Method.(type) {
+	case *jwt.SigningMethodRSA:
+		if v.jwks == nil {
+			return nil, fmt.Errorf("jwtauth: no -jwt-jwks-url configured for RS256 tokens")
+		}
+		kid, _ := token.Header["kid"].(string)
+		return v.jwks.Key(kid)
+	case *jwt.SigningMethodHMAC:
+		if len(v.secret) == 0 {
+			return nil, fmt.Errorf("jwtauth: no -jwt-secret configured for HS256 tokens")
+		}
+		return v.secret, nil
+	default:
+		return nil, fmt.Errorf("jwtauth: unsupported signing method %v", token.Header["alg"])
+	}
+}
+
+func claimToInt(v interface{}) (int, error) {
+	switch t := v.(type) {
+	case float64:
+		return int(t), nil
+	case int:
+		return t, nil
+	case string:
+		return strconv.Atoi(t)
+	default:
+		return 0, fmt.Errorf("unsupported claim type %T", v)
+	}
+}
@@ -0,0 +1,134 @@
+package jwtauth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestClaimToInt(t *testing.T) {
+	cases := []struct {
+		in      interface{}
+		want    int
+		wantErr bool
+	}{
+		{float64(42), 42, false},
+		{42, 42, false},
+		{"42", 42, false},
+		{"not a number", 0, true},
+		{3.14, 3, false}, // truncates, matches int(t) behavior
+		{true, 0, true},
+	}
+	for _, c := range cases {
+		got, err := claimToInt(c.in)
+		if c.wantErr != (err != nil) {
+			t.Errorf("claimToInt(%#v): wantErr=%v, got err=%v", c.in, c.wantErr, err)
+			continue
+		}
+		if err == nil && got != c.want {
+			t.Errorf("claimToInt(%#v) = %d, want %d", c.in, got, c.want)
+		}
+	}
+}
+
+func TestRSAPublicKeyFromJWK(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nStr := base64.RawURLEncoding.EncodeToString(priv.PublicKey.N.Bytes())
+	eBytes := big.NewInt(int64(priv.PublicKey.E)).Bytes()
+	eStr := base64.RawURLEncoding.EncodeToString(eBytes)
+
+	got, err := rsaPublicKeyFromJWK(nStr, eStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.E != priv.PublicKey.E {
+		t.Errorf("got E=%d, want %d", got.E, priv.PublicKey.E)
+	}
+	if got.N.Cmp(priv.PublicKey.N) != 0 {
+		t.Errorf("got N=%s, want %s", got.N, priv.PublicKey.N)
+	}
+}
+
+func TestRSAPublicKeyFromJWKInvalidEncoding(t *testing.T) {
+	if _, err := rsaPublicKeyFromJWK("not-base64url!!", "AQAB"); err == nil {
+		t.Error("expected an error for invalid base64url in n")
+	}
+}
+
+func TestValidateHS256(t *testing.T) {
+	old := *jwtSecret
+	*jwtSecret = "test-secret"
+	defer func() { *jwtSecret = old }()
+
+	v, err := NewValidator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v == nil {
+		t.Fatal("expected a non-nil Validator when -jwt-secret is set")
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"org_id": 5,
+		"role":   "admin",
+		"exp":    time.Now().Add(time.Hour).Unix(),
+	})
+	signed, err := token.SignedString([]byte("test-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := v.Validate(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.OrgId != 5 {
+		t.Errorf("got OrgId=%d, want 5", user.OrgId)
+	}
+	if !user.IsAdmin {
+		t.Error("expected role=admin to map to IsAdmin=true")
+	}
+}
+
+func TestValidateHS256WrongSecret(t *testing.T) {
+	old := *jwtSecret
+	*jwtSecret = "test-secret"
+	defer func() { *jwtSecret = old }()
+
+	v, err := NewValidator()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"org_id": 5})
+	signed, err := token.SignedString([]byte("a-different-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := v.Validate(signed); err == nil {
+		t.Error("expected validation to fail for a token signed with the wrong secret")
+	}
+}
+
+func TestNewValidatorDisabled(t *testing.T) {
+	oldSecret, oldURL := *jwtSecret, *jwksURL
+	*jwtSecret, *jwksURL = "", ""
+	defer func() { *jwtSecret, *jwksURL = oldSecret, oldURL }()
+
+	v, err := NewValidator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != nil {
+		t.Error("expected a nil Validator when neither -jwt-secret nor -jwt-jwks-url is set")
+	}
+}
@@ -0,0 +1,296 @@
+// Package limits implements per-tenant ingestion validation and rate
+// limiting for the gateway, modeled on Cortex's per-tenant
+// validation.Limits. A single default Limits value is loaded from a YAML
+// config file at startup, and may be overridden per-OrgId by a second,
+// hot-reloadable YAML file (the "runtime config") that is re-read whenever
+// the process receives SIGHUP.
+package limits
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/time/rate"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var (
+	configFile        = flag.String("limits-config", "", "yaml file defining the default per-tenant limits")
+	runtimeConfigFile = flag.String("runtime-config", "", "yaml file defining per-org limit overrides, reloaded on SIGHUP")
+
+	seriesTTL           = flag.Duration("limits-series-ttl", time.Hour, "how long a series counts towards an org's max-series-per-org limit after it was last seen")
+	seriesEvictInterval = flag.Duration("limits-series-evict-interval", 5*time.Minute, "how often the per-org seen-series set is swept for entries older than -limits-series-ttl")
+)
+
+// Limits holds the set of per-tenant limits enforced on the ingest path.
+type Limits struct {
+	IngestionEnabled     bool    `yaml:"ingestion_enabled"`
+	MaxSamplesPerRequest int     `yaml:"max_samples_per_request"`
+	MaxLabelNameLength   int     `yaml:"max_label_name_length"`
+	MaxLabelValueLength  int     `yaml:"max_label_value_length"`
+	MaxSeriesPerOrg      int     `yaml:"max_series_per_org"`
+	MaxMetricsPerSecond  float64 `yaml:"max_metrics_per_second"`
+	MaxMetricsBurst      int     `yaml:"max_metrics_burst"`
+}
+
+// DefaultLimits returns the Limits applied to an org with no explicit
+// override and no config file loaded.
+func DefaultLimits() Limits {
+	return Limits{
+		IngestionEnabled:     true,
+		MaxSamplesPerRequest: 1000,
+		MaxLabelNameLength:   1024,
+		MaxLabelValueLength:  2048,
+		MaxSeriesPerOrg:      100000,
+		MaxMetricsPerSecond:  10000,
+		MaxMetricsBurst:      20000,
+	}
+}
+
+// RejectReason classifies why a request was rejected, used both as the
+// "reason" stats counter label and to pick an HTTP status code.
+type RejectReason string
+
+const (
+	ReasonIngestionDisabled   RejectReason = "ingestion_disabled"
+	ReasonRateLimited         RejectReason = "rate_limited"
+	ReasonTooManySamples      RejectReason = "too_many_samples"
+	ReasonLabelNameTooLong    RejectReason = "label_name_too_long"
+	ReasonLabelValueTooLong   RejectReason = "label_value_too_long"
+	ReasonSeriesLimitExceeded RejectReason = "series_limit_exceeded"
+
+	// ReasonInvalidMetric is used by callers (not by this package) to
+	// classify a schema.MetricData.Validate() failure unrelated to any
+	// limits.Overrides check, e.g. an empty name or unrecognized Mtype, so
+	// it isn't misattributed to one of the reasons above.
+	ReasonInvalidMetric RejectReason = "invalid_metric"
+)
+
+// RejectedError is returned by CheckRequest/CheckMetric when a request or
+// metric should be rejected.
+type RejectedError struct {
+	Reason RejectReason
+	msg    string
+}
+
+func (e *RejectedError) Error() string { return e.msg }
+
+type runtimeConfig struct {
+	Overrides map[int]Limits `yaml:"overrides"`
+}
+
+// Overrides serves the effective Limits for a given OrgId, applying any
+// per-org override on top of the default, and enforces the sample-rate and
+// series-count limits across requests.
+type Overrides struct {
+	mutex     sync.RWMutex
+	defaults  Limits
+	overrides map[int]Limits
+	buckets   map[int]*rate.Limiter
+
+	seriesMutex sync.Mutex
+	// series maps orgId -> seriesId -> the last time that series was seen,
+	// so stale entries can be evicted and the set reflects active series
+	// rather than growing for the lifetime of the process.
+	series map[int]map[string]time.Time
+}
+
+// NewOverrides loads the default limits from -limits-config (if set) and
+// the per-org overrides from -runtime-config (if set), then starts a
+// goroutine that reloads the runtime config on SIGHUP.
+func NewOverrides() (*Overrides, error) {
+	o := &Overrides{
+		defaults:  DefaultLimits(),
+		overrides: make(map[int]Limits),
+		buckets:   make(map[int]*rate.Limiter),
+		series:    make(map[int]map[string]time.Time),
+	}
+	go o.evictStaleSeriesLoop()
+
+	if *configFile != "" {
+		defaults, err := loadDefaults(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		o.defaults = defaults
+	}
+
+	if *runtimeConfigFile != "" {
+		if err := o.reloadRuntimeConfig(); err != nil {
+			return nil, err
+		}
+		go o.watchSIGHUP()
+	}
+
+	return o, nil
+}
+
+func loadDefaults(path string) (Limits, error) {
+	defaults := DefaultLimits()
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return defaults, err
+	}
+	if err := yaml.Unmarshal(buf, &defaults); err != nil {
+		return defaults, err
+	}
+	return defaults, nil
+}
+
+// watchSIGHUP reloads the runtime config file every time the process
+// receives SIGHUP, logging (but not failing on) reload errors so a bad
+// config push doesn't take down ingestion.
+func (o *Overrides) watchSIGHUP() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	for range sighup {
+		if err := o.reloadRuntimeConfig(); err != nil {
+			glog.Errorf("limits: failed to reload runtime config %s: %s", *runtimeConfigFile, err)
+		} else {
+			glog.Infof("limits: reloaded runtime config %s", *runtimeConfigFile)
+		}
+	}
+}
+
+func (o *Overrides) reloadRuntimeConfig() error {
+	buf, err := ioutil.ReadFile(*runtimeConfigFile)
+	if err != nil {
+		return err
+	}
+	var cfg runtimeConfig
+	if err := yaml.Unmarshal(buf, &cfg); err != nil {
+		return err
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.overrides = cfg.Overrides
+	// drop the token buckets so orgs whose rate changed pick up the new
+	// limit on next use.
+	o.buckets = make(map[int]*rate.Limiter)
+	return nil
+}
+
+// ForOrg returns the effective Limits for the given OrgId.
+func (o *Overrides) ForOrg(orgId int) Limits {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+	if l, ok := o.overrides[orgId]; ok {
+		return l
+	}
+	return o.defaults
+}
+
+// CheckRequest validates that an org is allowed to ingest a request
+// containing numSamples samples, consuming numSamples tokens from its rate
+// bucket if so.
+func (o *Overrides) CheckRequest(orgId int, numSamples int) *RejectedError {
+	limit := o.ForOrg(orgId)
+	if !limit.IngestionEnabled {
+		return &RejectedError{ReasonIngestionDisabled, "ingestion disabled for this org"}
+	}
+	if limit.MaxSamplesPerRequest > 0 && numSamples > limit.MaxSamplesPerRequest {
+		return &RejectedError{ReasonTooManySamples, fmt.Sprintf("request contains %d samples, exceeding the limit of %d", numSamples, limit.MaxSamplesPerRequest)}
+	}
+	if !o.bucketFor(orgId, limit).AllowN(time.Now(), numSamples) {
+		return &RejectedError{ReasonRateLimited, "org has exceeded its ingestion rate limit"}
+	}
+	return nil
+}
+
+func (o *Overrides) bucketFor(orgId int, limit Limits) *rate.Limiter {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	b, ok := o.buckets[orgId]
+	if !ok {
+		b = rate.NewLimiter(rate.Limit(limit.MaxMetricsPerSecond), limit.MaxMetricsBurst)
+		o.buckets[orgId] = b
+	}
+	return b
+}
+
+// CheckMetric validates a single metric's name and tags against the org's
+// label length limits.
+func (o *Overrides) CheckMetric(orgId int, name string, tags []string) *RejectedError {
+	limit := o.ForOrg(orgId)
+	if limit.MaxLabelValueLength > 0 && len(name) > limit.MaxLabelValueLength {
+		return &RejectedError{ReasonLabelValueTooLong, fmt.Sprintf("metric name %q exceeds max label value length of %d", name, limit.MaxLabelValueLength)}
+	}
+	for _, tag := range tags {
+		key, value := tag, ""
+		if idx := strings.IndexByte(tag, '='); idx >= 0 {
+			key, value = tag[:idx], tag[idx+1:]
+		}
+		if limit.MaxLabelNameLength > 0 && len(key) > limit.MaxLabelNameLength {
+			return &RejectedError{ReasonLabelNameTooLong, fmt.Sprintf("label name %q exceeds max label name length of %d", key, limit.MaxLabelNameLength)}
+		}
+		if limit.MaxLabelValueLength > 0 && len(value) > limit.MaxLabelValueLength {
+			return &RejectedError{ReasonLabelValueTooLong, fmt.Sprintf("label value for %q exceeds max label value length of %d", key, limit.MaxLabelValueLength)}
+		}
+	}
+	return nil
+}
+
+// CheckSeries tracks the distinct series ids seen for an org and rejects
+// new series once the org's MaxSeriesPerOrg is reached. Series already seen
+// are always allowed through, and have their last-seen time refreshed so
+// evictStaleSeriesLoop keeps them counted as active.
+func (o *Overrides) CheckSeries(orgId int, id string) *RejectedError {
+	limit := o.ForOrg(orgId)
+	if limit.MaxSeriesPerOrg <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	o.seriesMutex.Lock()
+	defer o.seriesMutex.Unlock()
+	set, ok := o.series[orgId]
+	if !ok {
+		set = make(map[string]time.Time)
+		o.series[orgId] = set
+	}
+	if _, ok := set[id]; ok {
+		set[id] = now
+		return nil
+	}
+	if len(set) >= limit.MaxSeriesPerOrg {
+		return &RejectedError{ReasonSeriesLimitExceeded, fmt.Sprintf("org has reached its series limit of %d", limit.MaxSeriesPerOrg)}
+	}
+	set[id] = now
+	return nil
+}
+
+// evictStaleSeriesLoop periodically purges series not seen within
+// -limits-series-ttl, so MaxSeriesPerOrg tracks active cardinality instead
+// of every series an org has ever sent since the process started.
+func (o *Overrides) evictStaleSeriesLoop() {
+	ticker := time.NewTicker(*seriesEvictInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		o.evictStaleSeries()
+	}
+}
+
+func (o *Overrides) evictStaleSeries() {
+	cutoff := time.Now().Add(-*seriesTTL)
+	o.seriesMutex.Lock()
+	defer o.seriesMutex.Unlock()
+	for orgId, set := range o.series {
+		for id, lastSeen := range set {
+			if lastSeen.Before(cutoff) {
+				delete(set, id)
+			}
+		}
+		if len(set) == 0 {
+			delete(o.series, orgId)
+		}
+	}
+}
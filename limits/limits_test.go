@@ -0,0 +1,128 @@
+package limits
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func newTestOverrides(defaults Limits) *Overrides {
+	return &Overrides{
+		defaults:  defaults,
+		overrides: make(map[int]Limits),
+		buckets:   make(map[int]*rate.Limiter),
+		series:    make(map[int]map[string]time.Time),
+	}
+}
+
+func TestCheckRequestIngestionDisabled(t *testing.T) {
+	o := newTestOverrides(Limits{IngestionEnabled: false})
+	rejErr := o.CheckRequest(1, 1)
+	if rejErr == nil || rejErr.Reason != ReasonIngestionDisabled {
+		t.Fatalf("expected ReasonIngestionDisabled, got %v", rejErr)
+	}
+}
+
+func TestCheckRequestTooManySamples(t *testing.T) {
+	o := newTestOverrides(Limits{
+		IngestionEnabled:     true,
+		MaxSamplesPerRequest: 10,
+		MaxMetricsPerSecond:  1000,
+		MaxMetricsBurst:      1000,
+	})
+	if rejErr := o.CheckRequest(1, 5); rejErr != nil {
+		t.Fatalf("expected request within limit to be allowed, got %v", rejErr)
+	}
+	rejErr := o.CheckRequest(1, 11)
+	if rejErr == nil || rejErr.Reason != ReasonTooManySamples {
+		t.Fatalf("expected ReasonTooManySamples, got %v", rejErr)
+	}
+}
+
+func TestCheckRequestRateLimited(t *testing.T) {
+	o := newTestOverrides(Limits{
+		IngestionEnabled:     true,
+		MaxSamplesPerRequest: 1000,
+		MaxMetricsPerSecond:  1,
+		MaxMetricsBurst:      5,
+	})
+	if rejErr := o.CheckRequest(1, 5); rejErr != nil {
+		t.Fatalf("expected first request to exhaust the burst without rejection, got %v", rejErr)
+	}
+	rejErr := o.CheckRequest(1, 1)
+	if rejErr == nil || rejErr.Reason != ReasonRateLimited {
+		t.Fatalf("expected ReasonRateLimited once the burst is exhausted, got %v", rejErr)
+	}
+}
+
+func TestCheckRequestPerOrgBuckets(t *testing.T) {
+	o := newTestOverrides(Limits{
+		IngestionEnabled:     true,
+		MaxSamplesPerRequest: 1000,
+		MaxMetricsPerSecond:  1,
+		MaxMetricsBurst:      1,
+	})
+	if rejErr := o.CheckRequest(1, 1); rejErr != nil {
+		t.Fatalf("expected org 1's first request to be allowed, got %v", rejErr)
+	}
+	if rejErr := o.CheckRequest(2, 1); rejErr != nil {
+		t.Fatalf("org 2 has its own bucket and should be allowed, got %v", rejErr)
+	}
+}
+
+func TestCheckMetricLabelLengths(t *testing.T) {
+	o := newTestOverrides(Limits{MaxLabelNameLength: 5, MaxLabelValueLength: 5})
+	if rejErr := o.CheckMetric(1, "ok", []string{"a=b"}); rejErr != nil {
+		t.Fatalf("expected short name/tags to pass, got %v", rejErr)
+	}
+	if rejErr := o.CheckMetric(1, "toolongname", nil); rejErr == nil || rejErr.Reason != ReasonLabelValueTooLong {
+		t.Fatalf("expected ReasonLabelValueTooLong for an over-long metric name, got %v", rejErr)
+	}
+	if rejErr := o.CheckMetric(1, "ok", []string{"toolongkey=b"}); rejErr == nil || rejErr.Reason != ReasonLabelNameTooLong {
+		t.Fatalf("expected ReasonLabelNameTooLong for an over-long tag key, got %v", rejErr)
+	}
+	if rejErr := o.CheckMetric(1, "ok", []string{"a=toolongvalue"}); rejErr == nil || rejErr.Reason != ReasonLabelValueTooLong {
+		t.Fatalf("expected ReasonLabelValueTooLong for an over-long tag value, got %v", rejErr)
+	}
+}
+
+func TestCheckSeriesLimit(t *testing.T) {
+	o := newTestOverrides(Limits{MaxSeriesPerOrg: 2})
+	if rejErr := o.CheckSeries(1, "a"); rejErr != nil {
+		t.Fatalf("expected first series to be allowed, got %v", rejErr)
+	}
+	if rejErr := o.CheckSeries(1, "b"); rejErr != nil {
+		t.Fatalf("expected second series to be allowed, got %v", rejErr)
+	}
+	if rejErr := o.CheckSeries(1, "a"); rejErr != nil {
+		t.Fatalf("expected an already-seen series to always be allowed, got %v", rejErr)
+	}
+	rejErr := o.CheckSeries(1, "c")
+	if rejErr == nil || rejErr.Reason != ReasonSeriesLimitExceeded {
+		t.Fatalf("expected ReasonSeriesLimitExceeded once MaxSeriesPerOrg is reached, got %v", rejErr)
+	}
+	if rejErr := o.CheckSeries(2, "a"); rejErr != nil {
+		t.Fatalf("expected org 2's series count to be independent of org 1's, got %v", rejErr)
+	}
+}
+
+func TestEvictStaleSeries(t *testing.T) {
+	o := newTestOverrides(Limits{MaxSeriesPerOrg: 1})
+	if rejErr := o.CheckSeries(1, "stale"); rejErr != nil {
+		t.Fatalf("expected first series to be allowed, got %v", rejErr)
+	}
+
+	// backdate the series as if it was last seen well before the TTL.
+	o.seriesMutex.Lock()
+	o.series[1]["stale"] = time.Now().Add(-2 * *seriesTTL)
+	o.seriesMutex.Unlock()
+
+	o.evictStaleSeries()
+
+	// with the stale series evicted, a new series should fit under the
+	// still-in-effect MaxSeriesPerOrg of 1.
+	if rejErr := o.CheckSeries(1, "fresh"); rejErr != nil {
+		t.Fatalf("expected room for a new series after eviction, got %v", rejErr)
+	}
+}
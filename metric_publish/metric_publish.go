@@ -0,0 +1,72 @@
+// Package metric_publish forwards ingested metrics from the api handlers to
+// the downstream Kafka/Metrictank pipeline.
+package metric_publish
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/grafana/metrictank/stats"
+	"github.com/grafana/worldping-gw/spanlogger"
+	"gopkg.in/raintank/schema.v1"
+)
+
+var (
+	metricsPublished     = stats.NewCounter32("metric_publish.published")
+	metricsPublishFailed = stats.NewCounter32("metric_publish.failed")
+)
+
+// Publisher abstracts the downstream transport (Kafka) that ingested
+// metrics are forwarded to.
+type Publisher interface {
+	Publish(metrics []*schema.MetricData) error
+}
+
+var publisher Publisher
+
+// Init wires up the Publisher used by Publish, and starts the WAL (if
+// -wal-enabled) in front of it. It must be called once at startup, before
+// the api handlers start calling Publish.
+func Init(p Publisher) error {
+	publisher = p
+	return initWAL(p)
+}
+
+// Publish forwards metrics to the WAL, if enabled, or directly to the
+// configured Publisher otherwise. ctx should carry the server span for the
+// inbound request, so a direct Kafka publish shows up as a child span of it.
+// With the WAL enabled the batch is only appended to it here, and ctx is not
+// used: the replayer's later publish is not linked to the request's span.
+func Publish(ctx context.Context, metrics []*schema.MetricData) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+	if wal != nil {
+		return wal.Write(metrics)
+	}
+	return publishDirect(ctx, metrics)
+}
+
+// publishDirect sends metrics straight to the Publisher, wrapping the call
+// in a child span tagged with the Kafka-specific fields so the backend call
+// is visible in traces, and logging failures with the trace ID attached.
+func publishDirect(ctx context.Context, metrics []*schema.MetricData) error {
+	span, ctx := spanlogger.New(ctx, "metric_publish.Publish")
+	defer span.Finish()
+	span.SetTag("peer.service", "kafka")
+	span.SetTag("messaging.system", "kafka")
+	span.SetTag("messaging.batch_size", len(metrics))
+
+	if publisher == nil {
+		err := fmt.Errorf("metric_publish: no publisher configured")
+		span.Errorf("%s", err)
+		return err
+	}
+	if err := publisher.Publish(metrics); err != nil {
+		metricsPublishFailed.Add(len(metrics))
+		span.Errorf("failed to publish %d metrics to kafka: %s", len(metrics), err)
+		return err
+	}
+	metricsPublished.Add(len(metrics))
+	return nil
+}
@@ -0,0 +1,407 @@
+package metric_publish
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/grafana/metrictank/stats"
+	"gopkg.in/raintank/schema.v1"
+)
+
+var (
+	walEnabled       = flag.Bool("wal-enabled", false, "buffer metrics on disk and replay them when the publisher is unavailable")
+	walDir           = flag.String("wal-dir", "", "directory to store WAL segments in, required when -wal-enabled")
+	walFsync         = flag.String("wal-fsync", "interval", "fsync policy for WAL segments: always, interval, or never")
+	walFsyncInterval = flag.Duration("wal-fsync-interval", time.Second, "fsync interval used when -wal-fsync=interval")
+	walSegmentSize   = flag.Int64("wal-segment-size", 128<<20, "target size in bytes of a WAL segment before it is rotated")
+	walMaxSize       = flag.Int64("wal-max-size", 10<<30, "maximum total size in bytes of on-disk WAL segments, 0 for unlimited")
+	walMaxSizePolicy = flag.String("wal-max-size-policy", "block", "what to do once -wal-max-size is reached: block or drop-oldest")
+)
+
+var (
+	walSegmentsStat  = stats.NewGauge32("wal.segments")
+	walBytesStat     = stats.NewGauge32("wal.bytes")
+	walReplayLagStat = stats.NewGauge32("wal.replay.lag_seconds")
+)
+
+// wal is the process-wide WAL, nil unless -wal-enabled.
+var wal *WAL
+
+func initWAL(p Publisher) error {
+	if !*walEnabled {
+		return nil
+	}
+	w, err := newWAL(*walDir, p)
+	if err != nil {
+		return err
+	}
+	wal = w
+	go wal.replayLoop()
+	if *walFsync == "interval" {
+		go wal.fsyncLoop()
+	}
+	return nil
+}
+
+// segment is a single append-only WAL file. Records are appended to it
+// until it reaches -wal-segment-size, at which point it is closed for
+// writing and becomes eligible for replay.
+type segment struct {
+	seq  int64
+	path string
+	f    *os.File // nil once closed for writing
+	size int64
+
+	// replayOffset is the byte offset of the first not-yet-published
+	// record in the segment, updated as replaySegment makes progress so a
+	// publish failure partway through only retries the remaining records
+	// instead of redelivering the whole segment from the start.
+	replayOffset int64
+}
+
+// WAL is a segmented, on-disk write-ahead-log that buffers metrics batches
+// in front of a Publisher so that a brief publisher outage turns into
+// buffered catch-up instead of dropped, user-visible 500s.
+type WAL struct {
+	mu        sync.Mutex
+	dir       string
+	publisher Publisher
+	segments  []*segment
+	cur       *segment
+	nextSeq   int64
+}
+
+func newWAL(dir string, p Publisher) (*WAL, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("wal: -wal-dir must be set when -wal-enabled")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	w := &WAL{dir: dir, publisher: p}
+	if err := w.recover(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// recover runs at startup: it picks up any segments left behind by a
+// previous process (to be replayed) and opens a fresh segment to write to.
+func (w *WAL) recover() error {
+	entries, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		seq, ok := segmentSeq(e.Name())
+		if !ok {
+			continue
+		}
+		w.segments = append(w.segments, &segment{seq: seq, path: filepath.Join(w.dir, e.Name()), size: e.Size()})
+		if seq >= w.nextSeq {
+			w.nextSeq = seq + 1
+		}
+	}
+	sort.Slice(w.segments, func(i, j int) bool { return w.segments[i].seq < w.segments[j].seq })
+	if len(w.segments) > 0 {
+		glog.Infof("metric_publish: wal recovered %d segment(s) from %s for replay", len(w.segments), w.dir)
+	}
+	w.updateStatsLocked()
+	return w.rotateLocked()
+}
+
+func segmentName(seq int64) string {
+	return fmt.Sprintf("segment-%020d.wal", seq)
+}
+
+func segmentSeq(name string) (int64, bool) {
+	if !strings.HasPrefix(name, "segment-") || !strings.HasSuffix(name, ".wal") {
+		return 0, false
+	}
+	seq, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, "segment-"), ".wal"), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return seq, true
+}
+
+// rotateLocked closes the current segment (if any) for writing and opens a
+// new one. Callers must hold w.mu.
+func (w *WAL) rotateLocked() error {
+	if w.cur != nil {
+		if err := w.cur.f.Close(); err != nil {
+			return err
+		}
+		w.cur.f = nil
+	}
+	path := filepath.Join(w.dir, segmentName(w.nextSeq))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s := &segment{seq: w.nextSeq, path: path, f: f}
+	w.nextSeq++
+	w.segments = append(w.segments, s)
+	w.cur = s
+	w.updateStatsLocked()
+	return nil
+}
+
+func (w *WAL) updateStatsLocked() {
+	var total int64
+	for _, s := range w.segments {
+		total += s.size
+	}
+	walSegmentsStat.Set(len(w.segments))
+	walBytesStat.Set(int(total))
+}
+
+// Write appends a batch of metrics, tagged with the time it was enqueued
+// (used to compute replay lag), to the current segment.
+func (w *WAL) Write(metrics []*schema.MetricData) error {
+	buf, err := json.Marshal(metrics)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if *walMaxSize > 0 && w.totalSizeLocked() >= *walMaxSize {
+		if *walMaxSizePolicy != "drop-oldest" {
+			return fmt.Errorf("wal: on-disk size limit of %d bytes reached", *walMaxSize)
+		}
+		if err := w.dropOldestLocked(); err != nil {
+			glog.Errorf("metric_publish: wal failed to drop oldest segment: %s", err)
+		}
+	}
+
+	var hdr [12]byte
+	binary.BigEndian.PutUint64(hdr[0:8], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(hdr[8:12], uint32(len(buf)))
+	if _, err := w.cur.f.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := w.cur.f.Write(buf); err != nil {
+		return err
+	}
+	w.cur.size += int64(len(hdr) + len(buf))
+	w.updateStatsLocked()
+
+	if *walFsync == "always" {
+		if err := w.cur.f.Sync(); err != nil {
+			return err
+		}
+	}
+	if w.cur.size >= *walSegmentSize {
+		return w.rotateLocked()
+	}
+	return nil
+}
+
+func (w *WAL) totalSizeLocked() int64 {
+	var total int64
+	for _, s := range w.segments {
+		total += s.size
+	}
+	return total
+}
+
+// dropOldestLocked discards the oldest segment not currently being written
+// to, implementing the "drop-oldest" -wal-max-size-policy.
+func (w *WAL) dropOldestLocked() error {
+	for i, s := range w.segments {
+		if s == w.cur {
+			continue
+		}
+		if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		w.segments = append(w.segments[:i], w.segments[i+1:]...)
+		return nil
+	}
+	return nil
+}
+
+func (w *WAL) fsyncLoop() {
+	ticker := time.NewTicker(*walFsyncInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		w.mu.Lock()
+		if w.cur != nil && w.cur.f != nil {
+			if err := w.cur.f.Sync(); err != nil {
+				glog.Errorf("metric_publish: wal fsync failed: %s", err)
+			}
+		}
+		w.mu.Unlock()
+	}
+}
+
+// replayLoop drains closed segments into the publisher, oldest first,
+// truncating (deleting) each segment once every batch in it has been
+// acknowledged. It runs for the lifetime of the process.
+func (w *WAL) replayLoop() {
+	for {
+		s := w.oldestClosedSegment()
+		if s == nil {
+			time.Sleep(time.Second)
+			continue
+		}
+		if err := w.replaySegment(s); err != nil {
+			glog.Errorf("metric_publish: wal replay of %s failed: %s", s.path, err)
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+func (w *WAL) oldestClosedSegment() *segment {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, s := range w.segments {
+		if s != w.cur {
+			return s
+		}
+	}
+	return nil
+}
+
+// replaySegment publishes every not-yet-acknowledged batch in s, in order,
+// then deletes it. s.replayOffset tracks how far a previous attempt got, so
+// a publish failure partway through only leaves the remaining records (not
+// the whole segment) to retry on the next pass - otherwise a publisher that
+// is flaky rather than hard-down would redeliver already-published batches
+// on every retry. A short read at the tail of the file (io.ErrUnexpectedEOF)
+// is treated as a torn record left behind by a crash mid-append rather than
+// an error: the segment is truncated to the last complete record and replay
+// proceeds as normal, since otherwise that segment - and every segment
+// behind it - would be retried forever.
+func (w *WAL) replaySegment(s *segment) error {
+	f, err := os.OpenFile(s.path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	offset := s.replayOffset
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	for {
+		var hdr [12]byte
+		if _, err := io.ReadFull(f, hdr[:]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			if err == io.ErrUnexpectedEOF {
+				glog.Warningf("metric_publish: wal %s has a torn record header at offset %d, truncating", s.path, offset)
+				return w.truncateTornSegment(f, s, offset)
+			}
+			return err
+		}
+		enqueuedAt := time.Unix(0, int64(binary.BigEndian.Uint64(hdr[0:8])))
+		size := binary.BigEndian.Uint32(hdr[8:12])
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(f, buf); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				glog.Warningf("metric_publish: wal %s has a torn record body at offset %d, truncating", s.path, offset)
+				return w.truncateTornSegment(f, s, offset)
+			}
+			return err
+		}
+		recordLen := int64(len(hdr)) + int64(size)
+
+		var metrics []*schema.MetricData
+		if err := json.Unmarshal(buf, &metrics); err != nil {
+			glog.Errorf("metric_publish: wal dropping corrupt batch in %s: %s", s.path, err)
+			offset += recordLen
+			s.replayOffset = offset
+			continue
+		}
+		if err := publishDirect(context.Background(), metrics); err != nil {
+			// s.replayOffset still points at this record, which hasn't
+			// been acknowledged, so the next attempt resumes here instead
+			// of redelivering everything already published above.
+			return err
+		}
+		offset += recordLen
+		s.replayOffset = offset
+		walReplayLagStat.Set(int(time.Since(enqueuedAt) / time.Second))
+	}
+
+	return w.finishReplay(s)
+}
+
+// truncateTornSegment drops the incomplete trailing bytes of s (left behind
+// by a crash mid-append) and finishes replaying it as if it ended cleanly at
+// offset.
+func (w *WAL) truncateTornSegment(f *os.File, s *segment, offset int64) error {
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	return w.finishReplay(s)
+}
+
+func (w *WAL) finishReplay(s *segment) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i, seg := range w.segments {
+		if seg == s {
+			w.segments = append(w.segments[:i], w.segments[i+1:]...)
+			break
+		}
+	}
+	w.updateStatsLocked()
+	walReplayLagStat.Set(0)
+	return nil
+}
+
+// Rotate forces the current segment to be closed and a new one opened,
+// without waiting for it to reach -wal-segment-size.
+func Rotate() error {
+	if wal == nil {
+		return fmt.Errorf("metric_publish: wal is not enabled")
+	}
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	return wal.rotateLocked()
+}
+
+// Flush rotates the current segment and then replays every closed segment
+// synchronously, returning once the backlog existing at the time of the
+// call has been drained (or a publish error is hit).
+func Flush() error {
+	if wal == nil {
+		return fmt.Errorf("metric_publish: wal is not enabled")
+	}
+	if err := Rotate(); err != nil {
+		return err
+	}
+	for {
+		s := wal.oldestClosedSegment()
+		if s == nil {
+			return nil
+		}
+		if err := wal.replaySegment(s); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// Package spanlogger provides a small helper that ties glog error logging
+// to the active opentracing span, so operators can jump from an error log
+// line straight to the trace it happened in. Modeled on the spanlogger
+// Cortex's distributor uses for the same purpose.
+package spanlogger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/golang/glog"
+	opentracing "github.com/opentracing/opentracing-go"
+	otLog "github.com/opentracing/opentracing-go/log"
+)
+
+// SpanLogger wraps a child opentracing.Span and logs errors against both
+// the span and glog, prefixing the glog line with the span's trace ID when
+// one is available.
+type SpanLogger struct {
+	opentracing.Span
+}
+
+// New starts a child span named name from ctx and returns a SpanLogger
+// wrapping it, along with the context carrying the new span. Callers must
+// call Finish() on the returned SpanLogger when the operation completes.
+func New(ctx context.Context, name string) (*SpanLogger, context.Context) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, name)
+	return &SpanLogger{Span: span}, ctx
+}
+
+// Errorf logs an error against the span and against glog, prefixing the
+// glog line with the span's trace ID so the two can be correlated.
+func (s *SpanLogger) Errorf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	s.Span.LogFields(otLog.Error(errors.New(msg)))
+	if traceID, ok := traceIDFromSpan(s.Span); ok {
+		glog.Errorf("[trace_id=%s] %s", traceID, msg)
+	} else {
+		glog.Errorf("%s", msg)
+	}
+}
+
+// traceIDFromSpan calls the span context's TraceID method, if it has one
+// taking no arguments and returning a fmt.Stringer. That covers
+// jaeger-client-go's SpanContext (whose TraceID returns its own concrete
+// TraceID type) and compatible tracers, and lets us recover a
+// human-readable trace ID without taking a hard dependency on a specific
+// tracer implementation.
+func traceIDFromSpan(span opentracing.Span) (string, bool) {
+	sc := span.Context()
+	if sc == nil {
+		return "", false
+	}
+	m := reflect.ValueOf(sc).MethodByName("TraceID")
+	if !m.IsValid() || m.Type().NumIn() != 0 || m.Type().NumOut() != 1 {
+		return "", false
+	}
+	if tid, ok := m.Call(nil)[0].Interface().(fmt.Stringer); ok {
+		return tid.String(), true
+	}
+	return "", false
+}